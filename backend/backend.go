@@ -0,0 +1,185 @@
+// Package backend dispatches package install/verify operations to a native
+// package manager (apt, brew, ...) instead of the hand-rolled bash
+// scripts an Environment would otherwise need.
+package backend
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+)
+
+// Backend installs and verifies a single named package through an
+// underlying native package manager.
+type Backend interface {
+	// Install installs pkg.
+	Install(pkg string) error
+	// Verify returns nil if pkg is already installed.
+	Verify(pkg string) error
+	// Available reports whether this backend's package manager binary
+	// is present on the current machine.
+	Available() bool
+}
+
+// execBackend is a Backend backed by a single CLI binary with fixed
+// install/verify argument templates.
+type execBackend struct {
+	bin         string
+	installArgs func(pkg string) []string
+	verifyArgs  func(pkg string) []string
+	// verify, if set, overrides the verifyArgs/run(pkg) default. Use it
+	// when checking whether pkg is installed needs more than the native
+	// tool's bare exit code, e.g. inspecting its output or checking a
+	// different on-disk artifact.
+	verify func(pkg string) error
+}
+
+func (b execBackend) Available() bool {
+	_, err := exec.LookPath(b.bin)
+	return err == nil
+}
+
+func (b execBackend) Install(pkg string) error {
+	return run(b.bin, b.installArgs(pkg)...)
+}
+
+func (b execBackend) Verify(pkg string) error {
+	if b.verify != nil {
+		return b.verify(pkg)
+	}
+	return run(b.bin, b.verifyArgs(pkg)...)
+}
+
+func run(bin string, args ...string) error {
+	cmd := exec.Command(bin, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return errorString(stderr.String())
+		}
+		return err
+	}
+	return nil
+}
+
+// runOutput is run, but also captures and returns stdout for callers
+// that need to inspect it rather than just the exit code.
+func runOutput(bin string, args ...string) (string, error) {
+	cmd := exec.Command(bin, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return "", errorString(stderr.String())
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+type errorString string
+
+func (e errorString) Error() string { return string(e) }
+
+// registry maps the `backend:` name used in package definition YAML to
+// its implementation.
+var registry = map[string]Backend{
+	"apt": execBackend{
+		bin:         "apt-get",
+		installArgs: func(pkg string) []string { return []string{"install", "-y", pkg} },
+		// `apt-get -s install` simulates an install and exits 0 for any
+		// installable package whether or not it's already installed;
+		// `dpkg -s` reports actual install state.
+		verify: func(pkg string) error { return run("dpkg", "-s", pkg) },
+	},
+	"brew": execBackend{
+		bin:         "brew",
+		installArgs: func(pkg string) []string { return []string{"install", pkg} },
+		verifyArgs:  func(pkg string) []string { return []string{"list", "--versions", pkg} },
+	},
+	"pacman": execBackend{
+		bin:         "pacman",
+		installArgs: func(pkg string) []string { return []string{"-S", "--noconfirm", pkg} },
+		verifyArgs:  func(pkg string) []string { return []string{"-Qi", pkg} },
+	},
+	"dnf": execBackend{
+		bin:         "dnf",
+		installArgs: func(pkg string) []string { return []string{"install", "-y", pkg} },
+		verifyArgs:  func(pkg string) []string { return []string{"list", "installed", pkg} },
+	},
+	"snap": execBackend{
+		bin:         "snap",
+		installArgs: func(pkg string) []string { return []string{"install", pkg} },
+		verifyArgs:  func(pkg string) []string { return []string{"list", pkg} },
+	},
+	"flatpak": execBackend{
+		bin:         "flatpak",
+		installArgs: func(pkg string) []string { return []string{"install", "-y", pkg} },
+		verifyArgs:  func(pkg string) []string { return []string{"info", pkg} },
+	},
+	"cargo": execBackend{
+		bin:         "cargo",
+		installArgs: func(pkg string) []string { return []string{"install", pkg} },
+		verify:      verifyCargoInstalled,
+	},
+	"npm": execBackend{
+		bin:         "npm",
+		installArgs: func(pkg string) []string { return []string{"install", "-g", pkg} },
+		verifyArgs:  func(pkg string) []string { return []string{"list", "-g", pkg} },
+	},
+	"pip": execBackend{
+		bin:         "pip",
+		installArgs: func(pkg string) []string { return []string{"install", pkg} },
+		verifyArgs:  func(pkg string) []string { return []string{"show", pkg} },
+	},
+	"go": execBackend{
+		bin:         "go",
+		installArgs: func(pkg string) []string { return []string{"install", pkg} },
+		verify:      verifyGoInstalled,
+	},
+}
+
+// verifyCargoInstalled reports whether pkg appears in `cargo install
+// --list`, which always exits 0 and instead lists installed crates as
+// lines like "ripgrep v13.0.0:".
+func verifyCargoInstalled(pkg string) error {
+	out, err := runOutput("cargo", "install", "--list")
+	if err != nil {
+		return err
+	}
+	prefix := pkg + " v"
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return nil
+		}
+	}
+	return errorString("cargo package not installed: " + pkg)
+}
+
+// verifyGoInstalled reports whether pkg's built binary is present in
+// $GOPATH/bin. pkg is an import path (optionally with an @version
+// suffix as passed to `go install`), not a binary name, so `go version
+// -m` needs the resolved binary path rather than pkg itself.
+func verifyGoInstalled(pkg string) error {
+	gopath, err := runOutput("go", "env", "GOPATH")
+	if err != nil {
+		return err
+	}
+	modulePath := pkg
+	if i := strings.Index(modulePath, "@"); i >= 0 {
+		modulePath = modulePath[:i]
+	}
+	binName := modulePath
+	if i := strings.LastIndex(modulePath, "/"); i >= 0 {
+		binName = modulePath[i+1:]
+	}
+	return run("go", "version", "-m", strings.TrimSpace(gopath)+"/bin/"+binName)
+}
+
+// Get returns the Backend registered under name, if any.
+func Get(name string) (Backend, bool) {
+	b, ok := registry[name]
+	return b, ok
+}
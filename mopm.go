@@ -3,18 +3,31 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-yaml/yaml"
 	"github.com/urfave/cli"
+	"github.com/yammerjp/mopm/backend"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	gogithttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Environment struct {
@@ -24,6 +37,21 @@ type Environment struct {
 	Verification string
 	Privilege    bool
 	Script       string
+	// Backend names a native package manager (apt, brew, ...) to install
+	// and verify Package through, instead of Script/Verification.
+	Backend string
+	Package string
+	// Uninstall reverses Script. Required for `mopm uninstall`/`mopm
+	// autoremove` to work; lintPackage only warns if it is empty for
+	// now to give existing definitions a grace period.
+	Uninstall string
+	// Compatible lists extra distro ids (matched against the host's
+	// os-release ID and ID_LIKE) that this environment should also be
+	// selected for, e.g. an "ubuntu" environment with
+	// compatible: [debian] also matches a Debian host. An entry may pin
+	// a VERSION_ID with "id@version", e.g. "ubuntu@20.04", to only match
+	// that distro version.
+	Compatible []string
 }
 
 type Package struct {
@@ -36,6 +64,7 @@ type Package struct {
 type PackageFile struct {
 	Package *Package
 	Path    string
+	RepoUrl string
 }
 
 func (pkg Package) String() string {
@@ -86,8 +115,14 @@ func main() {
 			{
 				Name:  "update",
 				Usage: "download latest package definition files",
-				Action: func(_ *cli.Context) error {
-					return update()
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "upgrade",
+						Usage: "advance repositories pinned by mopm.lock",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return update(c.Bool("upgrade"))
 				},
 			},
 			{
@@ -117,8 +152,49 @@ func main() {
 			{
 				Name:  "install",
 				Usage: "install the package",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "print the planned install order without executing anything",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return install(c.Args().First(), c.Bool("dry-run"))
+				},
+			},
+			{
+				Name:  "freeze",
+				Usage: "pin the package and its dependencies in mopm.lock",
 				Action: func(c *cli.Context) error {
-					return install(c.Args().First())
+					return freeze(c.Args().First())
+				},
+			},
+			{
+				Name:  "restore",
+				Usage: "install every package pinned in mopm.lock",
+				Action: func(_ *cli.Context) error {
+					return restore()
+				},
+			},
+			{
+				Name:  "uninstall",
+				Usage: "uninstall the package",
+				Action: func(c *cli.Context) error {
+					return uninstall(c.Args().First())
+				},
+			},
+			{
+				Name:  "autoremove",
+				Usage: "uninstall dependency-only packages no longer needed",
+				Action: func(_ *cli.Context) error {
+					return autoremove()
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "list installed packages",
+				Action: func(_ *cli.Context) error {
+					return list()
 				},
 			},
 		},
@@ -130,38 +206,213 @@ func main() {
 	}
 }
 
-func update() error {
-	for _, url := range packageRepositories() {
-		path := repoUrl2repoPath(packageRepositories()[0])
-		_, err := os.Stat(path)
-		if err != nil {
-			message("Directory does not exist: " + path + "\nClone")
-			gitClone(path, url)
-		} else {
-			gitPull(path)
-		}
+func update(upgrade bool) error {
+	cfg, err := readConfig()
+	if err != nil {
+		return err
+	}
+	lock, err := readLockfile()
+	if err != nil {
+		return err
+	}
+
+	const maxConcurrentFetches = 4
+	sem := make(chan struct{}, maxConcurrentFetches)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stderrMu sync.Mutex
+	var failed []string
+
+	for _, repo := range sortedRepoEntries(cfg) {
+		repo := repo
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := updateRepository(cfg, repo, upgrade, lock, &stderrMu); err != nil {
+				mu.Lock()
+				failed = append(failed, repo.Url+": "+err.Error())
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to update %d repositor(y/ies):\n%s", len(failed), strings.Join(failed, "\n"))
 	}
 	return nil
 }
 
-func gitClone(path string, url string) {
-	_, err := git.PlainClone(path, false, &git.CloneOptions{
-		URL:      url,
-		Progress: os.Stderr,
-	})
-	checkIfError(err)
+func isRepoPinned(url string, lock *Lockfile) bool {
+	for _, entry := range lock.Packages {
+		if entry.RepoUrl == url {
+			return true
+		}
+	}
+	return false
 }
 
-func gitPull(path string) {
+// updateRepository clones or updates a single repo, streaming its git
+// progress to stderr with a per-repo prefix so concurrent fetches don't
+// interleave mid-line. It clones/fetches from repo's mirror if cfg
+// configures one, checks out repo.Branch if set, and authenticates via
+// ~/.netrc if repo.Auth is set.
+func updateRepository(cfg *Config, repo RepoEntry, upgrade bool, lock *Lockfile, stderrMu *sync.Mutex) error {
+	path := repoUrl2repoPath(repo.Url)
+	progress := &linePrefixWriter{prefix: repo.Url, mu: stderrMu, out: os.Stderr}
+	cloneUrl := cfg.resolveCloneUrl(repo)
+
+	auth, err := repoAuth(repo, cloneUrl)
+	if err != nil {
+		return err
+	}
+	var ref plumbing.ReferenceName
+	if repo.Branch != "" {
+		ref = plumbing.NewBranchReferenceName(repo.Branch)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(progress, "directory does not exist, cloning\n")
+		_, err := git.PlainClone(path, false, &git.CloneOptions{
+			URL:           cloneUrl,
+			Depth:         1,
+			Progress:      progress,
+			Auth:          auth,
+			ReferenceName: ref,
+		})
+		return err
+	}
+
+	if !upgrade && isRepoPinned(repo.Url, lock) {
+		fmt.Fprintf(progress, "pinned by mopm.lock, skip (pass --upgrade to advance it)\n")
+		return nil
+	}
+
 	r, err := git.PlainOpen(path)
-	checkIfError(err)
+	if err != nil {
+		return err
+	}
 	w, err := r.Worktree()
-	checkIfError(err)
+	if err != nil {
+		return err
+	}
+	// An already-cloned repo may still be on a different local branch
+	// than repo.Branch (e.g. it was added without one and Branch was
+	// just set), so switch to it before pulling.
+	if ref != "" {
+		if err := checkoutBranch(r, w, ref, progress, auth); err != nil {
+			return err
+		}
+	}
+	// Pull fetches from origin and fast-forwards the worktree.
 	err = w.Pull(&git.PullOptions{
+		RemoteName:    "origin",
+		Progress:      progress,
+		Auth:          auth,
+		ReferenceName: ref,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	return nil
+}
+
+// checkoutBranch switches w to ref, fetching and creating a local
+// tracking branch from origin first if ref does not exist locally yet.
+func checkoutBranch(r *git.Repository, w *git.Worktree, ref plumbing.ReferenceName, progress io.Writer, auth transport.AuthMethod) error {
+	if err := w.Checkout(&git.CheckoutOptions{Branch: ref}); err == nil {
+		return nil
+	}
+	branchName := ref.Short()
+	remoteRef := plumbing.NewRemoteReferenceName("origin", branchName)
+	refSpec := config.RefSpec("+refs/heads/" + branchName + ":" + remoteRef.String())
+	err := r.Fetch(&git.FetchOptions{
 		RemoteName: "origin",
-		Progress:   os.Stderr,
+		Progress:   progress,
+		Auth:       auth,
+		RefSpecs:   []config.RefSpec{refSpec},
 	})
-	checkIfError(err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	head, err := r.Reference(remoteRef, true)
+	if err != nil {
+		return err
+	}
+	return w.Checkout(&git.CheckoutOptions{Hash: head.Hash(), Branch: ref, Create: true})
+}
+
+// repoAuth resolves the git credentials to use when cloning/fetching
+// cloneUrl on behalf of repo, looking them up in ~/.netrc when repo.Auth
+// is set. Returns a nil AuthMethod (anonymous access) otherwise.
+func repoAuth(repo RepoEntry, cloneUrl string) (transport.AuthMethod, error) {
+	if !repo.Auth {
+		return nil, nil
+	}
+	u, err := url.Parse(cloneUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("repo %s has auth: true but its url scheme %q is not http(s); netrc auth is only supported over http(s)", repo.Url, u.Scheme)
+	}
+	login, password, err := netrcCredentials(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("repo %s has auth: true but %w", repo.Url, err)
+	}
+	return &gogithttp.BasicAuth{Username: login, Password: password}, nil
+}
+
+// netrcCredentials looks up the login/password for host in ~/.netrc.
+func netrcCredentials(host string) (login string, password string, err error) {
+	buf, err := ioutil.ReadFile(homeDir() + "/.netrc")
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(string(buf))
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] != "machine" || fields[i+1] != host {
+			continue
+		}
+		for j := i + 2; j+1 < len(fields) && fields[j] != "machine"; j += 2 {
+			switch fields[j] {
+			case "login":
+				login = fields[j+1]
+			case "password":
+				password = fields[j+1]
+			}
+		}
+		return login, password, nil
+	}
+	return "", "", errors.New("no netrc entry for host: " + host)
+}
+
+// linePrefixWriter prefixes every complete line written to it with
+// "[prefix] " before forwarding it to out, guarding out with mu so
+// concurrent writers never interleave a single line.
+type linePrefixWriter struct {
+	prefix string
+	mu     *sync.Mutex
+	out    io.Writer
+	buf    bytes.Buffer
+}
+
+func (w *linePrefixWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.mu.Lock()
+		fmt.Fprintf(w.out, "[%s] %s", w.prefix, line)
+		w.mu.Unlock()
+	}
+	return len(p), nil
 }
 
 func search(packageName string) error {
@@ -194,42 +445,388 @@ func verify(packageName string) error {
 }
 
 func verifyExec(env *Environment) error {
+	if env.Backend != "" {
+		b, ok := backend.Get(env.Backend)
+		if !ok {
+			return errors.New("Unknown backend: " + env.Backend)
+		}
+		if b.Verify(env.Package) != nil {
+			return errors.New("The package is not installed")
+		}
+		return nil
+	}
 	if execBash(env.Verification) != nil {
 		return errors.New("The package is not installed")
 	}
 	return nil
 }
 
-func install(packageName string) error {
+// installNode is one entry in the resolved dependency install order.
+type installNode struct {
+	Name    string
+	Env     *Environment
+	RepoUrl string
+}
+
+// resolveInstallOrder walks the Dependencies field of packageName and its
+// transitive dependencies for envId, returning them in topological order
+// (dependencies before dependents, packageName last). It fails on the first
+// unresolvable dependency or dependency cycle it finds.
+func resolveInstallOrder(packageName string, envId string) ([]installNode, error) {
+	visiting := map[string]bool{}
+	visited := map[string]bool{}
+	var order []installNode
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		if visited[name] {
+			return nil
+		}
+		if visiting[name] {
+			return errors.New("Dependency cycle detected at package: " + name)
+		}
+		visiting[name] = true
+		pkgFile, env, err := findPackageFileAndEnvironment(name, envId)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve dependency %s: %w", name, err)
+		}
+		for _, dep := range env.Dependencies {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		visited[name] = true
+		order = append(order, installNode{Name: name, Env: env, RepoUrl: pkgFile.RepoUrl})
+		return nil
+	}
+
+	if err := visit(packageName); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// blockingFailedDependency returns the first of node's direct
+// Dependencies that is in failed, or "" if none are. order is
+// topological, so by the time node is reached every dependency that
+// failed (or was itself blocked) is already recorded in failed.
+func blockingFailedDependency(node installNode, failed map[string]bool) string {
+	for _, dep := range node.Env.Dependencies {
+		if failed[dep] {
+			return dep
+		}
+	}
+	return ""
+}
+
+func install(packageName string, dryRun bool) error {
+	order, err := resolveInstallOrder(packageName, machineEnvId())
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+
+	if dryRun {
+		message("Planned install order:")
+		for i, node := range order {
+			message(fmt.Sprintf("  %d. %s", i+1, node.Name))
+		}
+		return nil
+	}
+
+	cfg, err := readConfig()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	lock, err := readLockfile()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	state, err := readState()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+
+	closures := transitiveDependencyClosures(order)
+	var installed, skipped, failed []string
+	failedSet := map[string]bool{}
+	stateDirty := false
+	for _, node := range order {
+		if dep := blockingFailedDependency(node, failedSet); dep != "" {
+			message(node.Name + ": blocked by failed dependency " + dep + ", skipping")
+			failed = append(failed, node.Name)
+			failedSet[node.Name] = true
+			continue
+		}
+		if entry, ok := lock.Packages[node.Name]; ok && entry.ScriptHash != scriptHash(node.Env) {
+			err := errors.New(node.Name + ": script/verification does not match mopm.lock, aborting")
+			message(err.Error())
+			return err
+		}
+		if verifyExec(node.Env) == nil {
+			message(node.Name + ": already installed, skipping")
+			skipped = append(skipped, node.Name)
+			recordInstalled(state, node.Name, machineEnvId(), node.Name != packageName)
+			stateDirty = true
+			continue
+		}
+		if err := installExec(cfg, node.Env); err != nil {
+			message(node.Name + ": " + err.Error())
+			failed = append(failed, node.Name)
+			failedSet[node.Name] = true
+			continue
+		}
+		if verifyExec(node.Env) != nil {
+			message(node.Name + ": finished installing script but failed to verify")
+			failed = append(failed, node.Name)
+			failedSet[node.Name] = true
+			continue
+		}
+		message(node.Name + ": installed successfully.")
+		installed = append(installed, node.Name)
+		recordFrozen(lock, node, node.Name != packageName, closures[node.Name])
+		recordInstalled(state, node.Name, machineEnvId(), node.Name != packageName)
+		stateDirty = true
+	}
+
+	if len(installed) > 0 {
+		if err := writeLockfile(lock); err != nil {
+			message(err.Error())
+		}
+	}
+	if stateDirty {
+		if err := writeState(state); err != nil {
+			message(err.Error())
+		}
+	}
+
+	message(fmt.Sprintf("installed: %d, skipped: %d, failed: %d", len(installed), len(skipped), len(failed)))
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to install: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func uninstall(packageName string) error {
 	env, err := findPackageEnvironment(packageName, machineEnvId())
 	if err != nil {
 		message(err.Error())
 		return err
 	}
-	if verifyExec(env) == nil {
-		message("The package is already installed")
+	cfg, err := readConfig()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	if err := uninstallExec(cfg, env); err != nil {
+		message(err.Error())
+		return err
+	}
+	state, err := readState()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	delete(state.Packages, packageName)
+	if err := writeState(state); err != nil {
+		message(err.Error())
+		return err
+	}
+	message(packageName + ": uninstalled successfully.")
+	return nil
+}
+
+// autoremove uninstalls every package that is tracked in state.json as
+// dependency-only and is no longer required by any explicitly installed
+// package's dependency closure.
+func autoremove() error {
+	state, err := readState()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	cfg, err := readConfig()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	needed := neededByExplicitPackages(state)
+
+	var removed, failed []string
+	for name, entry := range state.Packages {
+		if !entry.Dependency || needed[name] {
+			continue
+		}
+		env, err := findPackageEnvironment(name, entry.EnvId)
+		if err != nil {
+			message(name + ": " + err.Error())
+			failed = append(failed, name)
+			continue
+		}
+		if err := uninstallExec(cfg, env); err != nil {
+			message(name + ": " + err.Error())
+			failed = append(failed, name)
+			continue
+		}
+		delete(state.Packages, name)
+		removed = append(removed, name)
+	}
+	if err := writeState(state); err != nil {
+		message(err.Error())
+	}
+
+	message(fmt.Sprintf("removed: %d, failed: %d", len(removed), len(failed)))
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to autoremove: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// neededByExplicitPackages returns the transitive dependency closure of
+// every package in state that was explicitly requested (not installed
+// solely as someone else's dependency).
+func neededByExplicitPackages(state *State) map[string]bool {
+	needed := map[string]bool{}
+	visited := map[string]bool{}
+	var markNeeded func(name string)
+	markNeeded = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		env, err := findPackageEnvironment(name, machineEnvId())
+		if err != nil {
+			return
+		}
+		for _, dep := range env.Dependencies {
+			needed[dep] = true
+			markNeeded(dep)
+		}
+	}
+	for name, entry := range state.Packages {
+		if !entry.Dependency {
+			markNeeded(name)
+		}
+	}
+	return needed
+}
+
+func list() error {
+	state, err := readState()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	if len(state.Packages) == 0 {
+		message("No packages installed")
 		return nil
 	}
-	err = installExec(env.Privilege, env.Script)
+	for _, entry := range state.Packages {
+		kind := "explicit"
+		if entry.Dependency {
+			kind = "dependency"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", entry.Name, entry.EnvId, kind, entry.InstalledAt)
+	}
+	return nil
+}
+
+// freeze resolves packageName's dependency closure and pins each resolved
+// package's source repo commit and script/verification hash in mopm.lock,
+// without installing anything.
+func freeze(packageName string) error {
+	order, err := resolveInstallOrder(packageName, machineEnvId())
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	lock, err := readLockfile()
 	if err != nil {
 		message(err.Error())
 		return err
 	}
-	if verifyExec(env) != nil {
-		err = errors.New("Finished installing script but failed to verify")
+	closures := transitiveDependencyClosures(order)
+	for _, node := range order {
+		recordFrozen(lock, node, node.Name != packageName, closures[node.Name])
+	}
+	if err := writeLockfile(lock); err != nil {
 		message(err.Error())
 		return err
 	}
-	message("Installed successfully.")
+	message(fmt.Sprintf("Froze %d package(s) to %s", len(order), lockfilePath()))
 	return nil
 }
 
-func installExec(privilege bool, script string) error {
+// restore re-installs every package pinned in mopm.lock, aborting any
+// package whose resolved definition no longer matches its pinned hash.
+func restore() error {
+	lock, err := readLockfile()
+	if err != nil {
+		message(err.Error())
+		return err
+	}
+	if len(lock.Packages) == 0 {
+		message("mopm.lock has no pinned packages")
+		return nil
+	}
+	var failed []string
+	for name, entry := range lock.Packages {
+		if entry.Dependency {
+			// Only pinned because an explicitly frozen package depends
+			// on it; it comes along when that package is installed.
+			continue
+		}
+		if err := install(name, false); err != nil {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to restore: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func installExec(cfg *Config, env *Environment) error {
+	if env.Backend != "" {
+		if cfg.isBackendDisabled(env.Backend) {
+			return errors.New("Backend is disabled in config: " + env.Backend)
+		}
+		b, ok := backend.Get(env.Backend)
+		if !ok {
+			return errors.New("Unknown backend: " + env.Backend)
+		}
+		if !b.Available() {
+			return errors.New("Backend is not available on this machine: " + env.Backend)
+		}
+		if env.Privilege != machinePrivilege() {
+			return errors.New("Check privilege to install this package")
+		}
+		return b.Install(env.Package)
+	}
+	return runScriptWithPrivilege(cfg, env.Privilege, env.Script)
+}
+
+func uninstallExec(cfg *Config, env *Environment) error {
+	if env.Backend != "" {
+		return errors.New("Uninstalling backend-managed packages is not supported yet")
+	}
+	if env.Uninstall == "" {
+		return errors.New("Package does not define an uninstall script")
+	}
+	return runScriptWithPrivilege(cfg, env.Privilege, env.Uninstall)
+}
+
+func runScriptWithPrivilege(cfg *Config, privilege bool, script string) error {
 	// | package\user | root  | unroot |
 	// | ----         | ----  | ----   |
-	// | root         | OK    | FAIL   |
-	// | unroot       | OK(*) | OK     |
-	// (*)  If mopm is runnning on sudo (Need unroot username to get with $SUDO_USER)
+	// | root         | OK    | OK(*) |
+	// | unroot       | OK(**)| OK     |
+	// (*)  Elevated via cfg.privilegeCommand() instead of failing outright
+	// (**) If mopm is runnning on sudo (Need unroot username to get with $SUDO_USER)
 	if privilege == machinePrivilege() {
 		return execBash(script)
 	}
@@ -237,6 +834,9 @@ func installExec(privilege bool, script string) error {
 	if !privilege && isSudo {
 		return execBashUnsudo(script)
 	}
+	if privilege && !machinePrivilege() {
+		return execBashWithPrivilegeCommand(cfg.privilegeCommand(), script)
+	}
 	return errors.New("Check privilege to install this package")
 }
 
@@ -255,60 +855,398 @@ func homeDir() string {
 	return usr.HomeDir
 }
 
-func packageRepositories() []string {
-	defaultPackageRepoUrl := "https://github.com/basd4g/mopm-defs.git"
+// RepoEntry is one package definitions repository in ~/.mopm/config.yaml.
+type RepoEntry struct {
+	Url      string
+	Branch   string
+	Priority int
+	// Auth, when true, looks up credentials for this repo's host in
+	// ~/.netrc rather than cloning anonymously.
+	Auth bool
+}
+
+// Config is the on-disk representation of ~/.mopm/config.yaml.
+type Config struct {
+	Repositories []RepoEntry
+	// PrivilegeCommand elevates mopm to root to run a package's Script
+	// when mopm itself is not already root. One of "sudo", "doas",
+	// "pkexec". Defaults to "sudo".
+	PrivilegeCommand string
+	// BackendsDisabled lists backend names (see the backend package)
+	// that installExec must refuse to use even if available.
+	BackendsDisabled []string
+	// Mirrors maps a repository's canonical Url to a mirror Url to
+	// actually clone/fetch from. Local paths and mopm.lock entries
+	// still key off the canonical Url.
+	Mirrors map[string]string
+}
 
-	path := homeDir() + "/.mopm-repos"
+func (cfg *Config) privilegeCommand() string {
+	if cfg.PrivilegeCommand != "" {
+		return cfg.PrivilegeCommand
+	}
+	return "sudo"
+}
+
+func (cfg *Config) isBackendDisabled(name string) bool {
+	for _, disabled := range cfg.BackendsDisabled {
+		if disabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Config) resolveCloneUrl(repo RepoEntry) string {
+	if mirror, ok := cfg.Mirrors[repo.Url]; ok && mirror != "" {
+		return mirror
+	}
+	return repo.Url
+}
+
+func configPath() string {
+	return homeDir() + "/.mopm/config.yaml"
+}
+
+func legacyRepoListPath() string {
+	return homeDir() + "/.mopm-repos"
+}
+
+func defaultConfig() Config {
+	return Config{
+		Repositories: []RepoEntry{
+			{Url: "https://github.com/basd4g/mopm-defs.git"},
+		},
+		PrivilegeCommand: "sudo",
+	}
+}
+
+func readConfig() (*Config, error) {
+	path := configPath()
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		message("Create the file because it does not exist: " + path)
-		err = ioutil.WriteFile(path, []byte(defaultPackageRepoUrl), 0644)
-		checkIfError(err)
+		cfg, err := migrateLegacyRepoList()
+		if err != nil {
+			return nil, err
+		}
+		if err := writeConfig(cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
 	}
 	buf, err := ioutil.ReadFile(path)
-	checkIfError(err)
+	if err != nil {
+		return nil, err
+	}
+	cfg := Config{}
+	if err := yaml.Unmarshal(buf, &cfg); err != nil {
+		return nil, fmt.Errorf("Failed to parse config file: %s\nWrapped: %w", path, err)
+	}
+	return &cfg, nil
+}
 
-	var repos []string
+func writeConfig(cfg *Config) error {
+	buf, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	dir := homeDir() + "/.mopm"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath(), buf, 0644)
+}
+
+// migrateLegacyRepoList builds a Config from the plaintext ~/.mopm-repos
+// file if it exists, or the built-in default repository otherwise.
+func migrateLegacyRepoList() (*Config, error) {
+	legacyPath := legacyRepoListPath()
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+		cfg := defaultConfig()
+		return &cfg, nil
+	}
+	buf, err := ioutil.ReadFile(legacyPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg := defaultConfig()
+	cfg.Repositories = nil
+	priority := 0
 	for _, repo := range strings.Split(string(buf), "\n") {
-		if repo != "" && !strings.HasPrefix(repo, "#") {
-			repos = append(repos, strings.Trim(repo, " "))
+		repo = strings.Trim(repo, " ")
+		if repo == "" || strings.HasPrefix(repo, "#") {
+			continue
 		}
+		cfg.Repositories = append(cfg.Repositories, RepoEntry{Url: repo, Priority: priority})
+		priority++
 	}
-	if len(repos) == 0 {
-		checkIfError(errors.New("package repository url is not found in the file: " + path))
+	if len(cfg.Repositories) == 0 {
+		return nil, errors.New("package repository url is not found in the file: " + legacyPath)
 	}
+	message("Migrated " + legacyPath + " to " + configPath())
+	return &cfg, nil
+}
+
+// sortedRepoEntries returns cfg's repositories ordered by ascending
+// Priority (lower runs/matches first), without mutating cfg.
+func sortedRepoEntries(cfg *Config) []RepoEntry {
+	repos := append([]RepoEntry{}, cfg.Repositories...)
+	sort.SliceStable(repos, func(i, j int) bool { return repos[i].Priority < repos[j].Priority })
 	return repos
 }
 
+func packageRepositories() []string {
+	cfg, err := readConfig()
+	checkIfError(err)
+
+	var urls []string
+	for _, repo := range sortedRepoEntries(cfg) {
+		urls = append(urls, repo.Url)
+	}
+	if len(urls) == 0 {
+		checkIfError(errors.New("no package repositories configured in " + configPath()))
+	}
+	return urls
+}
+
 func repoUrl2repoPath(url string) string {
 	repo := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://"), ".git")
 	return homeDir() + "/.mopm/" + repo
 }
 
+// LockEntry pins one installed package to the repo commit and
+// script/verification hash it was resolved from, so a later install of
+// the same package can detect a tampered or silently-edited definition.
+type LockEntry struct {
+	Name       string
+	RepoUrl    string
+	CommitSha  string
+	ScriptHash string
+	// Dependencies is the full transitive closure of the package's
+	// dependencies at freeze/install time, not just its direct
+	// Env.Dependencies. restore() does not read it; it re-resolves each
+	// explicit entry's dependencies through resolveInstallOrder.
+	Dependencies []string
+	// Dependency is true if this package was pinned only because it is
+	// in an explicitly frozen package's dependency closure, not because
+	// it was itself passed to `mopm freeze`/`mopm install`. restore()
+	// only re-installs entries with Dependency false; their own
+	// dependencies come along for free via resolveInstallOrder.
+	Dependency bool
+}
+
+// Lockfile is the on-disk representation of ~/mopm.lock.
+type Lockfile struct {
+	Packages map[string]LockEntry
+}
+
+func lockfilePath() string {
+	return homeDir() + "/mopm.lock"
+}
+
+func readLockfile() (*Lockfile, error) {
+	path := lockfilePath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return &Lockfile{Packages: map[string]LockEntry{}}, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lock := Lockfile{}
+	if err := yaml.Unmarshal(buf, &lock); err != nil {
+		return nil, fmt.Errorf("Failed to parse lockfile: %s\nWrapped: %w", path, err)
+	}
+	if lock.Packages == nil {
+		lock.Packages = map[string]LockEntry{}
+	}
+	return &lock, nil
+}
+
+func writeLockfile(lock *Lockfile) error {
+	buf, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(lockfilePath(), buf, 0644)
+}
+
+func scriptHash(env *Environment) string {
+	sum := sha256.Sum256([]byte(env.Script + "\x00" + env.Verification + "\x00" + env.Backend + "\x00" + env.Package))
+	return hex.EncodeToString(sum[:])
+}
+
+func repoCommitSha(path string) (string, error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return "", err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
+func lockEntryFor(node installNode, isDependency bool, transitiveDeps []string) LockEntry {
+	commitSha, err := repoCommitSha(repoUrl2repoPath(node.RepoUrl))
+	if err != nil {
+		commitSha = ""
+	}
+	return LockEntry{
+		Name:         node.Name,
+		RepoUrl:      node.RepoUrl,
+		CommitSha:    commitSha,
+		ScriptHash:   scriptHash(node.Env),
+		Dependencies: transitiveDeps,
+		Dependency:   isDependency,
+	}
+}
+
+// recordFrozen pins node in lock, without downgrading an entry already
+// pinned as explicit (Dependency false) back to dependency-only.
+func recordFrozen(lock *Lockfile, node installNode, isDependency bool, transitiveDeps []string) {
+	if existing, ok := lock.Packages[node.Name]; ok && !existing.Dependency {
+		isDependency = false
+	}
+	lock.Packages[node.Name] = lockEntryFor(node, isDependency, transitiveDeps)
+}
+
+// transitiveDependencyClosures walks order (already topologically sorted by
+// resolveInstallOrder, dependencies before dependents) and returns, for each
+// node, the full set of packages it depends on directly or transitively.
+func transitiveDependencyClosures(order []installNode) map[string][]string {
+	closures := map[string][]string{}
+	for _, node := range order {
+		seen := map[string]bool{}
+		var closure []string
+		for _, dep := range node.Env.Dependencies {
+			if !seen[dep] {
+				seen[dep] = true
+				closure = append(closure, dep)
+			}
+			for _, transitive := range closures[dep] {
+				if !seen[transitive] {
+					seen[transitive] = true
+					closure = append(closure, transitive)
+				}
+			}
+		}
+		closures[node.Name] = closure
+	}
+	return closures
+}
+
+// StateEntry records one currently-installed package for `mopm list` and
+// `mopm autoremove`.
+type StateEntry struct {
+	Name        string
+	EnvId       string
+	InstalledAt string
+	// Dependency is true if this package was pulled in only to satisfy
+	// another package's Dependencies, not explicitly requested.
+	Dependency bool
+}
+
+// State is the on-disk representation of ~/.mopm/state.json.
+type State struct {
+	Packages map[string]StateEntry
+}
+
+func statePath() string {
+	return homeDir() + "/.mopm/state.json"
+}
+
+func readState() (*State, error) {
+	path := statePath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return &State{Packages: map[string]StateEntry{}}, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := State{}
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, fmt.Errorf("Failed to parse state file: %s\nWrapped: %w", path, err)
+	}
+	if state.Packages == nil {
+		state.Packages = map[string]StateEntry{}
+	}
+	return &state, nil
+}
+
+func writeState(state *State) error {
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := homeDir() + "/.mopm"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath(), buf, 0644)
+}
+
+// recordInstalled marks name as installed in state, without downgrading
+// a package already recorded as explicitly requested to dependency-only.
+func recordInstalled(state *State, name string, envId string, isDependency bool) {
+	if existing, ok := state.Packages[name]; ok && !existing.Dependency {
+		isDependency = false
+	}
+	state.Packages[name] = StateEntry{
+		Name:        name,
+		EnvId:       envId,
+		InstalledAt: time.Now().Format(time.RFC3339),
+		Dependency:  isDependency,
+	}
+}
+
 func findAllPackageFile(packageName string) ([]PackageFile, error) {
 	var pkgFiles []PackageFile
 	for _, url := range packageRepositories() {
 		path := repoUrl2repoPath(url) + "/definitions/" + packageName + ".yaml"
 		pkgFile, err := readPackageFile(path)
 		if err == nil {
+			pkgFile.RepoUrl = url
 			pkgFiles = append(pkgFiles, pkgFile)
 		}
 	}
 	return pkgFiles, nil
 }
 
-func findPackageEnvironment(packageName string, envId string) (*Environment, error) {
+func findPackageFileAndEnvironment(packageName string, envId string) (*PackageFile, *Environment, error) {
 	pkgFiles, err := findAllPackageFile(packageName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for _, pkgFile := range pkgFiles {
 		for _, env := range pkgFile.Package.Environments {
 			if env.Architecture+"@"+env.Platform == envId {
-				return &env, nil
+				return &pkgFile, &env, nil
+			}
+		}
+	}
+	// No exact arch@platform match: fall back to an environment that has
+	// opted into compatibility with this host's distro via `compatible:`.
+	arch := strings.SplitN(envId, "@", 2)[0]
+	for _, pkgFile := range pkgFiles {
+		for _, env := range pkgFile.Package.Environments {
+			if env.Architecture != arch {
+				continue
+			}
+			for _, compat := range env.Compatible {
+				if compatMatchesHost(compat) {
+					return &pkgFile, &env, nil
+				}
 			}
 		}
 	}
-	return nil, errors.New("Matched environment does not exist")
+	return nil, nil, errors.New("Matched environment does not exist")
+}
+
+func findPackageEnvironment(packageName string, envId string) (*Environment, error) {
+	_, env, err := findPackageFileAndEnvironment(packageName, envId)
+	return env, err
 }
 
 func readPackageFile(path string) (PackageFile, error) {
@@ -352,43 +1290,86 @@ func lintPackage(pkg *Package) error {
 	if len(pkg.Environments) == 0 {
 		return errors.New("Package must not be empty")
 	}
+	archRegex := regexp.MustCompile(`^(amd64|arm64|arm|386|riscv64)$`)
+	platformRegex := regexp.MustCompile(`^(darwin|linux(/[a-z0-9][a-z0-9.\-]*)?)$`)
+	distroIdRegex := regexp.MustCompile(`^[a-z0-9][a-z0-9.\-]*(@[a-z0-9][a-z0-9.\-]*)?$`)
 	for _, env := range pkg.Environments {
-		if env.Architecture != "amd64" {
-			return errors.New("Package architecture must be 'amd64'")
+		if !archRegex.MatchString(env.Architecture) {
+			return errors.New("Package architecture must be one of: amd64, arm64, arm, 386, riscv64")
 		}
-		if env.Platform != "darwin" && env.Platform != "linux/ubuntu" {
-			return errors.New("Package architecture must be 'darwin' or 'linux/ubuntu'")
+		if !platformRegex.MatchString(env.Platform) {
+			return errors.New("Package platform must be 'darwin' or 'linux' / 'linux/<distro>'")
 		}
 		for _, dpkg := range env.Dependencies {
 			if !pkgNameRegex.MatchString(dpkg) {
 				return errors.New("Package dependencies must consist of a-z, 0-9 and -(hyphen) charactors")
 			}
 		}
+		for _, compat := range env.Compatible {
+			if !distroIdRegex.MatchString(compat) {
+				return errors.New("Package compatible entries must be distro ids such as 'debian', optionally version-pinned as 'debian@11'")
+			}
+		}
+		if env.Backend != "" {
+			if _, ok := backend.Get(env.Backend); !ok {
+				return errors.New("Unknown backend: " + env.Backend)
+			}
+			if env.Package == "" {
+				return errors.New("Package must not be empty when backend is set")
+			}
+			continue
+		}
 		if env.Verification == "" {
 			return errors.New("Package verification must not be empty")
 		}
 		if env.Script == "" {
 			return errors.New("Package script must not be empty")
 		}
+		if env.Uninstall == "" {
+			// Grace period: will become a hard lint error once existing
+			// definitions have had time to add an Uninstall script.
+			message("warning: package '" + pkg.Name + "' does not define an uninstall script")
+		}
 	}
 	return nil
 }
 
-func machinePlatform() string {
-	if runtime.GOOS != "linux" {
-		return runtime.GOOS
-	}
+// osRelease holds the fields of /etc/os-release mopm cares about.
+type osRelease struct {
+	ID        string
+	IDLike    []string
+	VersionID string
+}
+
+func readOsRelease() osRelease {
 	buf, err := ioutil.ReadFile("/etc/os-release")
 	if err != nil {
 		panic("failed to read /etc/os-release inspite that your machine is linux")
 	}
+	values := map[string]string{}
 	for _, line := range regexp.MustCompile(`\r\n|\n\r|\n|\r`).Split(string(buf), -1) {
-		if strings.HasPrefix(line, "NAME=\"") && strings.HasSuffix(line, "\"") {
-			distributionName := strings.TrimSpace(strings.ToLower(line[6 : len(line)-1]))
-			return "linux/" + distributionName
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			continue
 		}
+		values[line[:eq]] = strings.Trim(line[eq+1:], `"`)
+	}
+	return osRelease{
+		ID:        strings.ToLower(values["ID"]),
+		IDLike:    strings.Fields(strings.ToLower(values["ID_LIKE"])),
+		VersionID: values["VERSION_ID"],
 	}
-	return "linux"
+}
+
+func machinePlatform() string {
+	if runtime.GOOS != "linux" {
+		return runtime.GOOS
+	}
+	rel := readOsRelease()
+	if rel.ID == "" {
+		return "linux"
+	}
+	return "linux/" + rel.ID
 }
 
 func machineEnvId() string {
@@ -396,6 +1377,56 @@ func machineEnvId() string {
 	return runtime.GOARCH + "@" + platform
 }
 
+// machineCompatibleIds returns the distro ids a compatible: [...] entry
+// may opt into: this machine's own os-release ID plus everything it
+// declares itself a derivative of via ID_LIKE.
+func machineCompatibleIds() []string {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	rel := readOsRelease()
+	var ids []string
+	if rel.ID != "" {
+		ids = append(ids, rel.ID)
+	}
+	return append(ids, rel.IDLike...)
+}
+
+// machineVersionId returns this host's os-release VERSION_ID, or "" on
+// non-Linux or if the host doesn't report one.
+func machineVersionId() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	return readOsRelease().VersionID
+}
+
+// compatMatchesHost reports whether a Environment.Compatible entry
+// matches this host: compat is either a bare distro id ("debian"),
+// matched against machineCompatibleIds(), or a distro id with a pinned
+// VERSION_ID ("debian@11"), which also requires machineVersionId() to
+// equal that version exactly.
+func compatMatchesHost(compat string) bool {
+	distroId, version := compat, ""
+	if i := strings.Index(compat, "@"); i >= 0 {
+		distroId, version = compat[:i], compat[i+1:]
+	}
+	idMatches := false
+	for _, id := range machineCompatibleIds() {
+		if id == distroId {
+			idMatches = true
+			break
+		}
+	}
+	if !idMatches {
+		return false
+	}
+	if version == "" {
+		return true
+	}
+	return version == machineVersionId()
+}
+
 func machinePrivilege() bool {
 	return os.Getuid() == 0
 }
@@ -412,6 +1443,17 @@ func execBashUnsudo(script string) error {
 	return cmd.Run()
 }
 
+// execBashWithPrivilegeCommand elevates to root via command (sudo, doas,
+// pkexec, ...) to run script, for a package that needs privilege when
+// mopm itself was not started as root.
+func execBashWithPrivilegeCommand(command string, script string) error {
+	cmd := exec.Command(command, "bash")
+	cmd.Stdin = bytes.NewBufferString("#!/bin/bash -e\n" + script + "\n")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
 func message(s string) {
 	fmt.Fprintln(os.Stderr, s)
 }